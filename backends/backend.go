@@ -0,0 +1,51 @@
+package backends
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Info describes an object's size and modification time, enough to answer
+// conditional requests without reading the object body.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Range is an inclusive byte range to read from an object. End of -1 means
+// read through the end of the object.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// StorageBackend abstracts where uploaded files physically live so requestHandler
+// doesn't need to know whether it's talking to S3 or the local disk.
+type StorageBackend interface {
+	// Stat returns the object's size and modification time.
+	Stat(key string) (Info, error)
+
+	// Open returns a reader for key. When rng is nil the whole object is
+	// returned, otherwise only the requested byte range.
+	Open(key string, rng *Range) (io.ReadCloser, error)
+
+	// PresignedURL returns a URL the client can fetch key from directly
+	// instead of having this proxy stream the bytes, or "" if the backend
+	// has no such concept (or size doesn't warrant it).
+	PresignedURL(key string, size int64) (string, error)
+}
+
+// New selects a StorageBackend based on the STORAGE_BACKEND env var ("s3" or
+// "localfs"), defaulting to "s3" to match the proxy's historical behavior.
+func New() (StorageBackend, error) {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "localfs":
+		return NewLocalFSBackend(os.Getenv("LOCALFS_ROOT")), nil
+	case "s3", "":
+		return NewS3Backend(os.Getenv("S3_ENDPOINT")), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", os.Getenv("STORAGE_BACKEND"))
+	}
+}
@@ -0,0 +1,70 @@
+package backends
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type localFSBackend struct {
+	root string
+}
+
+// NewLocalFSBackend serves files out of root, the way http.ServeFile would.
+func NewLocalFSBackend(root string) *localFSBackend {
+	if root == "" {
+		root = "."
+	}
+
+	return &localFSBackend{root: root}
+}
+
+func (b *localFSBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.Clean("/"+key))
+}
+
+func (b *localFSBackend) Stat(key string) (Info, error) {
+	info, err := os.Stat(b.path(key))
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *localFSBackend) Open(key string, rng *Range) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if rng == nil {
+		return f, nil
+	}
+
+	if _, err := f.Seek(rng.Start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if rng.End == -1 {
+		return f, nil
+	}
+
+	return &limitedReadCloser{r: io.LimitReader(f, rng.End-rng.Start+1), c: f}, nil
+}
+
+// PresignedURL is a no-op for localfs; there's no second URL to redirect to.
+func (b *localFSBackend) PresignedURL(key string, size int64) (string, error) {
+	return "", nil
+}
+
+// limitedReadCloser caps reads to a byte range while still closing the
+// underlying file once the caller is done with it.
+type limitedReadCloser struct {
+	r io.Reader
+	c io.Closer
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) { return l.r.Read(p) }
+func (l *limitedReadCloser) Close() error                { return l.c.Close() }
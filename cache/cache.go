@@ -0,0 +1,118 @@
+// Package cache provides a bounded, TTL-based LRU in front of Mongo and the
+// storage backend so the proxy doesn't re-fetch the same hot uploads on
+// every request.
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/Higure-wtf/Proxy/backends"
+)
+
+type entry struct {
+	file      bson.M
+	body      []byte
+	info      backends.Info
+	expiresAt time.Time
+	accesses  uint64
+}
+
+// Cache caches file documents keyed by filename/shortId/invisibleURL,
+// optionally alongside the object's bytes when they're small enough.
+type Cache struct {
+	lru           *lru.Cache
+	mu            sync.Mutex
+	ttl           time.Duration
+	maxEntryBytes int64
+
+	hits   uint64
+	misses uint64
+}
+
+// New creates a Cache holding up to size entries for ttl, caching object
+// bytes alongside the document only when they're under maxEntryBytes.
+func New(size int, ttl time.Duration, maxEntryBytes int64) *Cache {
+	l, _ := lru.New(size)
+	return &Cache{lru: l, ttl: ttl, maxEntryBytes: maxEntryBytes}
+}
+
+// MaxEntryBytes reports the size above which object bytes aren't cached.
+func (c *Cache) MaxEntryBytes() int64 {
+	return c.maxEntryBytes
+}
+
+// Get returns the cached document and, if it was small enough to cache,
+// its bytes and size/mtime.
+func (c *Cache) Get(key string) (file bson.M, body []byte, info backends.Info, ok bool) {
+	v, found := c.lru.Get(key)
+	if !found {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, nil, backends.Info{}, false
+	}
+
+	e := v.(*entry)
+	if time.Now().After(e.expiresAt) {
+		c.lru.Remove(key)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, nil, backends.Info{}, false
+	}
+
+	atomic.AddUint64(&e.accesses, 1)
+	atomic.AddUint64(&c.hits, 1)
+	return e.file, e.body, e.info, true
+}
+
+// Set caches file under key, along with body/info if body fits under
+// maxEntryBytes.
+func (c *Cache) Set(key string, file bson.M, body []byte, info backends.Info) {
+	if int64(len(body)) > c.maxEntryBytes {
+		body, info = nil, backends.Info{}
+	}
+
+	c.lru.Add(key, &entry{file: file, body: body, info: info, expiresAt: time.Now().Add(c.ttl)})
+}
+
+// Stats reports cumulative hit/miss counts, for exposing as cache hit ratio.
+func (c *Cache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// StartRefresher periodically re-fetches the document for any entry that's
+// been accessed at least hotThreshold times since its last refresh, so hot
+// items don't fall out of cache from TTL expiry alone.
+func (c *Cache) StartRefresher(interval time.Duration, hotThreshold uint64, fetch func(key string) (bson.M, error)) {
+	go func() {
+		for range time.Tick(interval) {
+			for _, key := range c.lru.Keys() {
+				v, found := c.lru.Peek(key)
+				if !found {
+					continue
+				}
+
+				e := v.(*entry)
+				if atomic.LoadUint64(&e.accesses) < hotThreshold {
+					continue
+				}
+				atomic.StoreUint64(&e.accesses, 0)
+
+				k := key.(string)
+				go func() {
+					file, err := fetch(k)
+					if err != nil {
+						return
+					}
+
+					c.mu.Lock()
+					body, info := e.body, e.info
+					c.mu.Unlock()
+					c.Set(k, file, body, info)
+				}()
+			}
+		}
+	}()
+}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
-	"log"
+	"io"
+	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 	"github.com/valyala/fasthttp"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/Higure-wtf/Proxy/backends"
+	"github.com/Higure-wtf/Proxy/cache"
+	"github.com/Higure-wtf/Proxy/metrics"
+	"github.com/Higure-wtf/Proxy/oembed"
+	"github.com/Higure-wtf/Proxy/thumbnail"
+	"github.com/fasthttp/websocket"
 	"github.com/joho/godotenv"
+	"github.com/rs/zerolog"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -34,12 +43,32 @@ type Response struct {
 	Error   string `json:"error"`
 }
 
+// embedData feeds embedTemplate. PlayerHTML, when set, takes priority over
+// Image/Video so oEmbed-provided markup (e.g. an iframe) renders as-is.
+type embedData struct {
+	FileURL    string
+	OEmbedURL  string
+	Desc       string
+	Color      string
+	Image      bool
+	Video      bool
+	User       string
+	Size       string
+	Name       string
+	Thumbnail  string
+	PlayerHTML template.HTML
+	BlurHash   string
+}
+
 var (
-	shortenerCol *mongo.Collection
-	collection   *mongo.Collection
-	invisibleURL *mongo.Collection
-	mongoContext = context.TODO()
-	svc          *s3.S3
+	shortenerCol   *mongo.Collection
+	collection     *mongo.Collection
+	invisibleURL   *mongo.Collection
+	mongoContext   = context.TODO()
+	storage        backends.StorageBackend
+	fileCache      *cache.Cache
+	logger         zerolog.Logger
+	oembedRegistry *oembed.Registry
 )
 
 const (
@@ -49,7 +78,11 @@ const (
 			<meta charset="UTF-8">
 			<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
 			<meta http-equiv="x-ua-compatible" content="ie=edge">
-			{{ if .Image }}
+			{{ if .PlayerHTML }}
+			<meta name="twitter:card" content="player" />
+			{{ if .Thumbnail }}<meta property="og:image" content="{{.Thumbnail}}" />{{ end }}
+			<meta property="og:description" content="{{.Desc}}" />
+			{{ else if .Image }}
 			<meta name="twitter:card" content="summary_large_image" />
 			<meta property="og:image" content="{{.FileURL}}" />
 			<meta property="og:description" content="{{.Desc}}" />
@@ -65,8 +98,15 @@ const (
 		<body>
 			<center>
 				<div class="vertical-center">
-						{{ if .Image }}
-						<img style="-webkit-user-select: none;margin: auto;box-shadow: 0 0 5px rgb(0, 0, 0, 0.5);" src="{{.FileURL}}" />
+						{{ if .PlayerHTML }}
+						{{ .PlayerHTML }}
+						{{ else if .Image }}
+						<div style="position: relative; margin: auto;">
+							{{ if .BlurHash }}
+							<canvas class="blurhash-placeholder" width="32" height="32" style="position: absolute; top: 0; left: 0; width: 100%; height: 100%; z-index: -1;"></canvas>
+							{{ end }}
+							<img style="-webkit-user-select: none;margin: auto;box-shadow: 0 0 5px rgb(0, 0, 0, 0.5);" src="{{.FileURL}}" />
+						</div>
 						{{ else if .Video }}
 						<video style="-webkit-user-select: none;margin: auto;box-shadow: 0 0 5px rgb(0, 0, 0, 0.5);" controls autoplay>
 							<source src="{{ .FileURL }}">
@@ -87,10 +127,28 @@ const (
 						    cursor: pointer;
 						">Download</button>
 						{{ end }}
-						
+
 						<h5>Uploaded by: <span class="info">{{.User}}</span></h5>
 				</div>
 			</center>
+			{{ if .BlurHash }}
+			<script src="https://cdn.jsdelivr.net/npm/blurhash@2.0.5/dist/blurhash.min.js"></script>
+			<script>
+				(function() {
+					// Always decode at a small fixed size and let CSS upscale the
+					// canvas — decoding at the source image's full resolution would
+					// allocate a multi-megabyte ImageData for every preview load.
+					var size = 32;
+					var canvas = document.querySelector(".blurhash-placeholder");
+					if (!canvas) return;
+					var pixels = blurhash.decode("{{ .BlurHash }}", size, size);
+					var ctx = canvas.getContext("2d");
+					var imageData = ctx.createImageData(size, size);
+					imageData.data.set(pixels);
+					ctx.putImageData(imageData, 0, 0);
+				})();
+			</script>
+			{{ end }}
 		</body>
 	</html>`
 
@@ -107,20 +165,94 @@ const (
 )
 
 func main() {
+	logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal().Err(err).Msg("failed to load .env")
 	}
 
-	connectToS3(os.Getenv("S3_ENDPOINT"))
+	storage, err = backends.New()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage backend")
+	}
 	connectToDatabase(os.Getenv("MONGO_URI"))
 
-	handler := fasthttp.CompressHandler(requestHandler)
+	fileCache = cache.New(cacheSizeFromEnv(), cacheTTLFromEnv(), cacheMaxEntryBytesFromEnv())
+	fileCache.StartRefresher(time.Minute, 5, refreshCacheEntry)
+
+	providersPath := os.Getenv("OEMBED_PROVIDERS_PATH")
+	if providersPath == "" {
+		providersPath = "providers.json"
+	}
+	oembedRegistry, err = oembed.Load(providersPath, oembedTTLFromEnv(), oembedCacheSizeFromEnv())
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to load oembed providers; shortened links will only redirect")
+	}
+
+	startBlurhashWorkers(blurhashScanIntervalFromEnv(), blurhashWorkersFromEnv())
+
+	handler := fasthttp.CompressHandler(withObservability(requestHandler))
+	logger.Info().Str("port", os.Getenv("PORT")).Msg("listening")
 	if err := fasthttp.ListenAndServe(":"+os.Getenv("PORT"), handler); err != nil {
-		log.Fatal(err)
+		logger.Fatal().Err(err).Msg("server stopped")
+	}
+}
+
+// withObservability wraps next with Prometheus metrics and a structured
+// access log entry per request, tagged with fasthttp's per-request ID.
+func withObservability(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		next(ctx)
+		duration := time.Since(start)
+
+		requestPath := string(ctx.Path())
+		route := routeClass(requestPath)
+		status := ctx.Response.StatusCode()
+
+		metrics.RequestsTotal.WithLabelValues(route, strconv.Itoa(status)).Inc()
+		metrics.RequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+		// ContentLength is -1 for chunked/streamed responses (e.g.
+		// SetBodyStreamWriter's unknown-length path); Counter.Add panics on a
+		// negative value, so only count known lengths.
+		if n := ctx.Response.Header.ContentLength(); n > 0 {
+			metrics.BytesServed.Add(float64(n))
+		}
+
+		logger.Info().
+			Uint64("request_id", ctx.ID()).
+			Str("method", string(ctx.Method())).
+			Str("path", requestPath).
+			Str("route", route).
+			Int("status", status).
+			Dur("duration", duration).
+			Msg("request")
 	}
+}
 
-	defer log.Printf("Listening to port %s", os.Getenv("PORT"))
+// routeClass maps a request path to a small, fixed set of route labels for
+// metrics, mirroring requestHandler's own switch so cardinality stays
+// bounded regardless of how many distinct filenames/shortIds exist.
+func routeClass(requestPath string) string {
+	basePath := path.Base(requestPath)
+
+	switch {
+	case requestPath == "/metrics":
+		return "/metrics"
+	case requestPath == "/preview":
+		return "/preview"
+	case requestPath == "/":
+		return "/"
+	case strings.HasSuffix(basePath, ".json"):
+		return "/json"
+	case strings.HasPrefix(requestPath, "/s/") && basePath != "s":
+		return "/s"
+	case basePath != "" && basePath != "favicon.ico":
+		return "/file"
+	default:
+		return "/other"
+	}
 }
 
 func requestHandler(ctx *fasthttp.RequestCtx) {
@@ -129,12 +261,20 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 	host := string(ctx.Host())
 
 	switch {
+	case requestPath == "/metrics":
+		metrics.Handler()(ctx)
+	case requestPath == "/preview":
+		handlePreview(ctx)
 	case requestPath == "/":
 		ctx.Redirect("https://higure.wtf", 301)
 	case strings.HasSuffix(basePath, ".json"):
 		requestPath = strings.SplitN(basePath, ".json", 2)[0]
-		var file bson.M
-		if err := collection.FindOne(mongoContext, bson.M{"filename": requestPath}).Decode(&file); err != nil {
+		file, _, _, err := lookupFile("file:"+requestPath, func() (bson.M, error) {
+			var f bson.M
+			err := collection.FindOne(mongoContext, bson.M{"filename": requestPath}).Decode(&f)
+			return f, err
+		})
+		if err != nil {
 			sendErr(ctx, "invalid file")
 			ctx.Done()
 			return
@@ -151,11 +291,15 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 			Title:   embed["title"].(string),
 			Author:  embed["author"].(string),
 		}); err != nil {
-			log.Fatal(err)
+			logger.Error().Err(err).Uint64("request_id", ctx.ID()).Msg("failed to encode oembed response")
 		}
 	case strings.HasPrefix(requestPath, "/s/") && basePath != "s":
-		var shortened bson.M
-		if err := shortenerCol.FindOne(mongoContext, bson.M{"shortId": basePath}).Decode(&shortened); err != nil {
+		shortened, _, _, err := lookupFile("short:"+basePath, func() (bson.M, error) {
+			var s bson.M
+			err := shortenerCol.FindOne(mongoContext, bson.M{"shortId": basePath}).Decode(&s)
+			return s, err
+		})
+		if err != nil {
 			sendErr(ctx, "invalid short link")
 			ctx.Done()
 			return
@@ -166,25 +310,68 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 			destination = "https://" + shortened["destination"].(string)
 		}
 
+		if oembedRegistry != nil {
+			if provider, ok := oembedRegistry.Match(destination); ok {
+				maxWidth, _ := strconv.Atoi(string(ctx.QueryArgs().Peek("maxwidth")))
+				maxHeight, _ := strconv.Atoi(string(ctx.QueryArgs().Peek("maxheight")))
+
+				resp, err := oembedRegistry.Fetch(provider, destination, maxWidth, maxHeight)
+				if err != nil {
+					logger.Error().Err(err).Str("destination", destination).Msg("oembed fetch failed")
+				} else {
+					renderEmbedTemplate(ctx, embedData{
+						FileURL:    destination,
+						OEmbedURL:  destination,
+						Desc:       resp.Title,
+						Color:      "#000000",
+						User:       resp.AuthorName,
+						Name:       resp.Title,
+						Thumbnail:  resp.ThumbnailURL,
+						PlayerHTML: template.HTML(resp.HTML),
+					})
+					ctx.Done()
+					return
+				}
+			}
+		}
+
 		ctx.Redirect(destination, 301)
 		ctx.Done()
 	case basePath != "" && basePath != "favicon.ico":
 		var file bson.M
+		var cachedBody []byte
+		var cachedInfo backends.Info
 		if strings.HasSuffix(basePath, "\u200B") {
-			if err := invisibleURL.FindOne(mongoContext, bson.M{"_id": basePath}).Decode(&file); err != nil {
+			invisible, _, _, err := lookupFile("inv:"+basePath, func() (bson.M, error) {
+				var f bson.M
+				err := invisibleURL.FindOne(mongoContext, bson.M{"_id": basePath}).Decode(&f)
+				return f, err
+			})
+			if err != nil {
 				sendErr(ctx, "no invisible url or file was found")
 				ctx.Done()
 				return
 			}
-			if file != nil {
-				if err := collection.FindOne(mongoContext, bson.M{"filename": file["filename"]}).Decode(&file); err != nil {
+			if invisible != nil {
+				file, cachedBody, cachedInfo, err = lookupFile("file:"+invisible["filename"].(string), func() (bson.M, error) {
+					var f bson.M
+					err := collection.FindOne(mongoContext, bson.M{"filename": invisible["filename"]}).Decode(&f)
+					return f, err
+				})
+				if err != nil {
 					sendErr(ctx, "invalid file")
 					ctx.Done()
 					return
 				}
 			}
 		} else {
-			if err := collection.FindOne(mongoContext, bson.M{"filename": basePath}).Decode(&file); err != nil {
+			var err error
+			file, cachedBody, cachedInfo, err = lookupFile("file:"+basePath, func() (bson.M, error) {
+				var f bson.M
+				err := collection.FindOne(mongoContext, bson.M{"filename": basePath}).Decode(&f)
+				return f, err
+			})
+			if err != nil {
 				sendErr(ctx, "invalid file")
 				ctx.Done()
 				return
@@ -197,72 +384,32 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 			return
 		}
 
-		resp, err := svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(os.Getenv("S3_BUCKET_NAME")),
-			Key:    aws.String(file["key"].(string)),
-		})
-		if err != nil {
-			sendErr(ctx, err.Error())
-			ctx.Done()
-			return
-		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			sendErr(ctx, err.Error())
-			ctx.Done()
-			return
-		}
-
-		mimetype := strings.SplitN(file["mimetype"].(string), "/", 2)[0]
+		fullMimetype := file["mimetype"].(string)
+		mimetype := strings.SplitN(fullMimetype, "/", 2)[0]
+		cacheKey := "file:" + file["filename"].(string)
 		cdnURL := os.Getenv("S3_ENDPOINT") + "/" + os.Getenv("S3_BUCKET_NAME") + "/" + file["key"].(string)
 		embed := file["embed"].(primitive.M)
 		uploader := file["uploader"].(primitive.M)
 
 
-		embed["description"] = strings.ReplaceAll(embed["description"].(string), "{domain}", host)
-
 		if embed["enabled"] == true {
-			t, err := template.New("embed").Parse(embedTemplate)
-			if err != nil {
-				sendErr(ctx, err.Error())
-				ctx.Done()
-				return
-			}
-
-			data := struct {
-				FileURL   string
-				OEmbedURL string
-				Desc      string
-				Color     string
-				Image     bool
-				Video     bool
-				User string
-				Size string
-				Name string
-
-			}{
+			description := strings.ReplaceAll(embed["description"].(string), "{domain}", host)
+			renderEmbedTemplate(ctx, embedData{
 				FileURL:   cdnURL,
 				OEmbedURL: "https://" + host + "/" + file["filename"].(string) + ".json",
-				Desc:      embed["description"].(string),
+				Desc:      description,
 				Color:     embed["color"].(string),
 				Image:     mimetype == "image",
-				User: 	   uploader["username"].(string),
+				User:      uploader["username"].(string),
 				Name:      file["filename"].(string),
 				Size:      file["size"].(string),
-				Video:      mimetype == "video",
-			}
-
-			ctx.SetContentType("text/html")
-			err = t.Execute(ctx, data)
-			if err != nil {
-				sendErr(ctx, err.Error())
-				ctx.Done()
-			}
+				Video:     mimetype == "video",
+				BlurHash:  blurhashField(file),
+			})
+			ctx.Done()
 		} else if file["showLink"] == true {
 			if mimetype == "video" {
-				ctx.SetContentType(deref(resp.ContentType))
-				ctx.SetBody(body)
+				serveFile(ctx, file, fullMimetype, cacheKey, cachedBody, cachedInfo)
 				ctx.Done()
 			} else {
 				t, err := template.New("showLink").Parse(showLinkTemplate)
@@ -286,38 +433,555 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 				}
 			}
 		} else {
-			ctx.SetContentType(deref(resp.ContentType))
-			ctx.SetBody(body)
+			serveFile(ctx, file, fullMimetype, cacheKey, cachedBody, cachedInfo)
 			ctx.Done()
 		}
 	}
 }
 
-func sendErr(ctx *fasthttp.RequestCtx, errMsg string) {
-	ctx.Response.Header.SetCanonical([]byte("Content-Type"), []byte("application/json"))
-	if err := json.NewEncoder(ctx).Encode(Response{Success: false, Error: errMsg}); err != nil {
-		log.Fatal(err)
+// blurhashField reads the optional blurhash field a file document gains
+// once the background worker has processed it.
+func blurhashField(file bson.M) string {
+	hash, _ := file["blurhash"].(string)
+	return hash
+}
+
+// executeEmbedTemplate parses and executes embedTemplate with data into w,
+// the single rendering path shared by the file-serving embed, the
+// oEmbed-backed /s/ render path, and the /preview websocket.
+func executeEmbedTemplate(w io.Writer, data embedData) error {
+	t, err := template.New("embed").Parse(embedTemplate)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, data)
+}
+
+// renderEmbedTemplate executes embedTemplate straight onto the response.
+func renderEmbedTemplate(ctx *fasthttp.RequestCtx, data embedData) {
+	ctx.SetContentType("text/html")
+	if err := executeEmbedTemplate(ctx, data); err != nil {
+		sendErr(ctx, err.Error())
 	}
 }
 
-func connectToS3(endpoint string) {
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), ""),
-		Endpoint:         aws.String(endpoint),
-		Region:           aws.String("us-east-1"),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
+// serveFile answers a file-serving request with conditional (If-None-Match /
+// If-Modified-Since) and Range support, computing and caching an ETag on the
+// file document the first time the whole object is streamed from the storage
+// backend; range requests and presigned redirects don't compute one. When
+// cachedBody is non-nil
+// the object bytes are served straight from the cache instead of hitting
+// the storage backend.
+func serveFile(ctx *fasthttp.RequestCtx, file bson.M, mimetype string, cacheKey string, cachedBody []byte, cachedInfo backends.Info) {
+	key := file["key"].(string)
+
+	info := cachedInfo
+	if cachedBody == nil {
+		var err error
+		info, err = statTimed(key)
+		if err != nil {
+			sendErr(ctx, err.Error())
+			return
+		}
+	}
+
+	etag, hasEtag := file["etag"].(string)
+	quotedEtag := `"` + etag + `"`
+
+	ctx.Response.Header.Set("Accept-Ranges", "bytes")
+	ctx.Response.Header.SetLastModified(info.ModTime)
+	if hasEtag {
+		ctx.Response.Header.Set("ETag", quotedEtag)
+	}
+
+	if hasEtag && string(ctx.Request.Header.Peek("If-None-Match")) == quotedEtag {
+		ctx.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+	if ims := ctx.Request.Header.Peek("If-Modified-Since"); len(ims) > 0 {
+		if t, err := http.ParseTime(string(ims)); err == nil && !info.ModTime.After(t) {
+			ctx.SetStatusCode(fasthttp.StatusNotModified)
+			return
+		}
+	}
+
+	if rangeHeader := string(ctx.Request.Header.Peek("Range")); rangeHeader != "" {
+		rng, err := parseRange(rangeHeader, info.Size)
+		if err != nil {
+			ctx.Response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			ctx.SetStatusCode(fasthttp.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		ctx.SetStatusCode(fasthttp.StatusPartialContent)
+		ctx.Response.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.Start, rng.End, info.Size))
+		ctx.SetContentType(mimetype)
+
+		if cachedBody != nil {
+			ctx.SetBody(cachedBody[rng.Start : rng.End+1])
+			return
+		}
+
+		reader, err := openTimed(key, &rng)
+		if err != nil {
+			sendErr(ctx, err.Error())
+			return
+		}
+		ctx.SetBodyStream(reader, int(rng.End-rng.Start+1))
+		return
+	}
+
+	ctx.SetContentType(mimetype)
+
+	if cachedBody != nil {
+		ctx.SetBody(cachedBody)
+		return
 	}
-	newSession := session.New(s3Config)
-	svc = s3.New(newSession)
 
-    defer fmt.Println("Connected to S3")
+	if url, err := storage.PresignedURL(key, info.Size); err == nil && url != "" {
+		ctx.Redirect(url, fasthttp.StatusFound)
+		return
+	}
+
+	reader, err := openTimed(key, nil)
+	if err != nil {
+		sendErr(ctx, err.Error())
+		return
+	}
+
+	if info.Size <= fileCache.MaxEntryBytes() {
+		body, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			sendErr(ctx, err.Error())
+			return
+		}
+
+		if !hasEtag {
+			sum := sha256.Sum256(body)
+			etag = hex.EncodeToString(sum[:])
+			cacheETag(file, etag)
+			file["etag"] = etag
+		}
+
+		fileCache.Set(cacheKey, file, body, info)
+		ctx.SetBody(body)
+		return
+	}
+
+	if hasEtag {
+		ctx.SetBodyStream(reader, int(info.Size))
+		return
+	}
+
+	hasher := sha256.New()
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer reader.Close()
+		io.Copy(w, io.TeeReader(reader, hasher))
+		cacheETag(file, hex.EncodeToString(hasher.Sum(nil)))
+	})
+}
+
+// statTimed and openTimed wrap the storage backend's calls with
+// higure_proxy_storage_duration_seconds observations.
+func statTimed(key string) (backends.Info, error) {
+	start := time.Now()
+	info, err := storage.Stat(key)
+	metrics.S3Duration.WithLabelValues("stat").Observe(time.Since(start).Seconds())
+	return info, err
+}
+
+func openTimed(key string, rng *backends.Range) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := storage.Open(key, rng)
+	metrics.S3Duration.WithLabelValues("open").Observe(time.Since(start).Seconds())
+	return reader, err
+}
+
+// cacheETag persists a freshly computed ETag on the file document so future
+// requests don't have to hash the whole object again.
+func cacheETag(file bson.M, etag string) {
+	if _, err := collection.UpdateOne(mongoContext,
+		bson.M{"filename": file["filename"]},
+		bson.M{"$set": bson.M{"etag": etag}},
+	); err != nil {
+		logger.Error().Err(err).Interface("filename", file["filename"]).Msg("failed to cache etag")
+	}
+}
+
+// lookupFile consults fileCache for cacheKey before falling back to query,
+// caching the resulting document (without its body) on a miss.
+func lookupFile(cacheKey string, query func() (bson.M, error)) (bson.M, []byte, backends.Info, error) {
+	if file, body, info, ok := fileCache.Get(cacheKey); ok {
+		metrics.CacheHits.Inc()
+		return cloneDoc(file), body, info, nil
+	}
+	metrics.CacheMisses.Inc()
+
+	start := time.Now()
+	file, err := query()
+	metrics.MongoDuration.WithLabelValues("find").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, nil, backends.Info{}, err
+	}
+
+	fileCache.Set(cacheKey, file, nil, backends.Info{})
+	return cloneDoc(file), nil, backends.Info{}, nil
+}
+
+// cloneDoc deep-copies a Mongo document (and any nested bson.M/primitive.M
+// submaps) so callers can mutate fields like embed["description"] in place
+// without racing other requests sharing the same cached document, or
+// permanently baking request-specific values (e.g. {domain} substitution)
+// into the cache.
+func cloneDoc(doc bson.M) bson.M {
+	if doc == nil {
+		return nil
+	}
+
+	clone := make(bson.M, len(doc))
+	for k, v := range doc {
+		clone[k] = cloneValue(v)
+	}
+	return clone
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case bson.M:
+		return cloneDoc(vv)
+	case primitive.M:
+		clone := make(primitive.M, len(vv))
+		for k, v2 := range vv {
+			clone[k] = cloneValue(v2)
+		}
+		return clone
+	case primitive.A:
+		clone := make(primitive.A, len(vv))
+		for i, v2 := range vv {
+			clone[i] = cloneValue(v2)
+		}
+		return clone
+	default:
+		return v
+	}
+}
+
+// refreshCacheEntry re-runs the Mongo lookup behind a "kind:value" cache key,
+// used by fileCache's background refresher to keep hot entries warm.
+func refreshCacheEntry(cacheKey string) (bson.M, error) {
+	parts := strings.SplitN(cacheKey, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cache key %q", cacheKey)
+	}
+
+	kind, value := parts[0], parts[1]
+	var file bson.M
+	var err error
+	switch kind {
+	case "file":
+		err = collection.FindOne(mongoContext, bson.M{"filename": value}).Decode(&file)
+	case "short":
+		err = shortenerCol.FindOne(mongoContext, bson.M{"shortId": value}).Decode(&file)
+	case "inv":
+		err = invisibleURL.FindOne(mongoContext, bson.M{"_id": value}).Decode(&file)
+	default:
+		err = fmt.Errorf("unknown cache key kind %q", kind)
+	}
+
+	return file, err
+}
+
+// cacheSizeFromEnv, cacheTTLFromEnv and cacheMaxEntryBytesFromEnv read
+// CACHE_SIZE, CACHE_TTL_SECONDS and CACHE_MAX_ENTRY_BYTES, falling back to
+// sane defaults when unset or invalid.
+func cacheSizeFromEnv() int {
+	if raw := os.Getenv("CACHE_SIZE"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			return v
+		}
+	}
+	return 1024
+}
+
+func cacheTTLFromEnv() time.Duration {
+	if raw := os.Getenv("CACHE_TTL_SECONDS"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			return time.Duration(v) * time.Second
+		}
+	}
+	return 5 * time.Minute
+}
+
+func cacheMaxEntryBytesFromEnv() int64 {
+	if raw := os.Getenv("CACHE_MAX_ENTRY_BYTES"); raw != "" {
+		if v, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return v
+		}
+	}
+	return 10 * 1024 * 1024
+}
+
+// oembedTTLFromEnv reads OEMBED_CACHE_TTL_SECONDS, falling back to a sane
+// default when unset or invalid.
+func oembedTTLFromEnv() time.Duration {
+	if raw := os.Getenv("OEMBED_CACHE_TTL_SECONDS"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			return time.Duration(v) * time.Second
+		}
+	}
+	return 30 * time.Minute
+}
+
+// oembedCacheSizeFromEnv reads OEMBED_CACHE_SIZE, bounding how many distinct
+// shortened-link destinations' oEmbed responses stay cached at once.
+func oembedCacheSizeFromEnv() int {
+	if raw := os.Getenv("OEMBED_CACHE_SIZE"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			return v
+		}
+	}
+	return 1024
+}
+
+// startBlurhashWorkers launches a small pool that backfills blurhash/width/
+// height on image documents missing them, polling Mongo every interval.
+func startBlurhashWorkers(interval time.Duration, workers int) {
+	jobs := make(chan bson.M)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for file := range jobs {
+				computeAndSaveBlurhash(file)
+			}
+		}()
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			cursor, err := collection.Find(mongoContext, bson.M{
+				"mimetype": bson.M{"$regex": "^image/"},
+				"blurhash": bson.M{"$exists": false},
+			})
+			if err != nil {
+				logger.Error().Err(err).Msg("failed to scan for missing blurhashes")
+				continue
+			}
+
+			for cursor.Next(mongoContext) {
+				var file bson.M
+				if err := cursor.Decode(&file); err != nil {
+					logger.Error().Err(err).Msg("failed to decode file while scanning for missing blurhashes")
+					continue
+				}
+				jobs <- file
+			}
+			cursor.Close(mongoContext)
+		}
+	}()
+}
+
+// computeAndSaveBlurhash fetches file's object, computes its BlurHash and
+// dimensions, and persists them on the document.
+func computeAndSaveBlurhash(file bson.M) {
+	key := file["key"].(string)
+
+	reader, err := openTimed(key, nil)
+	if err != nil {
+		logger.Error().Err(err).Interface("filename", file["filename"]).Msg("failed to open file for blurhash")
+		return
+	}
+	defer reader.Close()
+
+	result, err := thumbnail.Compute(reader, 4, 3)
+	if err != nil {
+		logger.Error().Err(err).Interface("filename", file["filename"]).Msg("failed to compute blurhash")
+
+		// Mark it as done so the scan's blurhash:$exists:false filter stops
+		// picking it up — some image mimetypes (svg, webp) have no decoder
+		// registered and would otherwise be re-downloaded every interval
+		// forever. BlurHash is empty, so embedTemplate just skips it.
+		if _, err := collection.UpdateOne(mongoContext,
+			bson.M{"filename": file["filename"]},
+			bson.M{"$set": bson.M{"blurhash": ""}},
+		); err != nil {
+			logger.Error().Err(err).Interface("filename", file["filename"]).Msg("failed to mark file as blurhash-skipped")
+		}
+		return
+	}
+
+	if _, err := collection.UpdateOne(mongoContext,
+		bson.M{"filename": file["filename"]},
+		bson.M{"$set": bson.M{"blurhash": result.Hash, "width": result.Width, "height": result.Height}},
+	); err != nil {
+		logger.Error().Err(err).Interface("filename", file["filename"]).Msg("failed to save blurhash")
+	}
+}
+
+// blurhashWorkersFromEnv and blurhashScanIntervalFromEnv read BLURHASH_WORKERS
+// and BLURHASH_SCAN_INTERVAL_SECONDS, falling back to sane defaults.
+func blurhashWorkersFromEnv() int {
+	if raw := os.Getenv("BLURHASH_WORKERS"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			return v
+		}
+	}
+	return 2
+}
+
+func blurhashScanIntervalFromEnv() time.Duration {
+	if raw := os.Getenv("BLURHASH_SCAN_INTERVAL_SECONDS"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			return time.Duration(v) * time.Second
+		}
+	}
+	return 5 * time.Minute
+}
+
+// parseRange parses a single-range "Range: bytes=start-end" header.
+func parseRange(header string, size int64) (backends.Range, error) {
+	header = strings.TrimPrefix(header, "bytes=")
+	parts := strings.SplitN(header, "-", 2)
+	if len(parts) != 2 {
+		return backends.Range{}, fmt.Errorf("malformed range %q", header)
+	}
+
+	// A suffix range ("bytes=-N") has no start and means "the last N bytes".
+	if parts[0] == "" {
+		if parts[1] == "" {
+			return backends.Range{}, fmt.Errorf("malformed range %q", header)
+		}
+		suffixLen, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return backends.Range{}, err
+		}
+		if suffixLen > size {
+			suffixLen = size
+		}
+		return backends.Range{Start: size - suffixLen, End: size - 1}, nil
+	}
+
+	rng := backends.Range{End: -1}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return backends.Range{}, err
+	}
+	rng.Start = start
+
+	if parts[1] != "" {
+		end, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return backends.Range{}, err
+		}
+		rng.End = end
+	}
+
+	if rng.End == -1 {
+		rng.End = size - 1
+	}
+	if rng.Start > rng.End || rng.End >= size {
+		return backends.Range{}, fmt.Errorf("range %q out of bounds for size %d", header, size)
+	}
+
+	return rng, nil
+}
+
+// previewSettings is the embed-settings message sent by the dashboard over
+// the /preview websocket, one per keystroke/change the user makes.
+type previewSettings struct {
+	FileURL     string `json:"fileUrl"`
+	Name        string `json:"name"`
+	Size        string `json:"size"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Color       string `json:"color"`
+	Image       bool   `json:"image"`
+	Video       bool   `json:"video"`
+}
+
+var previewUpgrader = websocket.FastHTTPUpgrader{
+	CheckOrigin: func(ctx *fasthttp.RequestCtx) bool { return true },
+}
+
+// handlePreview upgrades /preview?token=... to a websocket, authenticating
+// the short-lived token against the main higure.wtf API, then streams back
+// rendered embedTemplate HTML for every previewSettings message it receives
+// so the dashboard can show a live Discord-card preview.
+func handlePreview(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.QueryArgs().Peek("token"))
+	if !validatePreviewToken(token) {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return
+	}
+
+	err := previewUpgrader.Upgrade(ctx, func(conn *websocket.Conn) {
+		defer conn.Close()
+
+		for {
+			var settings previewSettings
+			if err := conn.ReadJSON(&settings); err != nil {
+				return
+			}
+
+			var buf bytes.Buffer
+			err := executeEmbedTemplate(&buf, embedData{
+				FileURL: settings.FileURL,
+				Name:    settings.Name,
+				Size:    settings.Size,
+				Desc:    settings.Description,
+				User:    settings.Author,
+				Color:   settings.Color,
+				Image:   settings.Image,
+				Video:   settings.Video,
+			})
+			if err != nil {
+				conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+				continue
+			}
+
+			if err := conn.WriteMessage(websocket.TextMessage, buf.Bytes()); err != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		logger.Error().Err(err).Uint64("request_id", ctx.ID()).Msg("failed to upgrade preview websocket")
+	}
+}
+
+// validatePreviewToken checks token against the main higure.wtf API's
+// short-lived preview-token endpoint.
+func validatePreviewToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	apiURL := os.Getenv("HIGURE_API_URL")
+	if apiURL == "" {
+		return false
+	}
+
+	statusCode, _, err := fasthttp.Get(nil, apiURL+"/internal/preview-tokens/"+token)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to validate preview token")
+		return false
+	}
+
+	return statusCode == fasthttp.StatusOK
+}
+
+func sendErr(ctx *fasthttp.RequestCtx, errMsg string) {
+	ctx.Response.Header.SetCanonical([]byte("Content-Type"), []byte("application/json"))
+	if err := json.NewEncoder(ctx).Encode(Response{Success: false, Error: errMsg}); err != nil {
+		logger.Error().Err(err).Uint64("request_id", ctx.ID()).Msg("failed to encode error response")
+	}
 }
 
 func connectToDatabase(mongoURL string) {
 	client, err := mongo.Connect(mongoContext, options.Client().ApplyURI(mongoURL))
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal().Err(err).Msg("failed to connect to mongo")
 	}
 
 	database := client.Database("higure")
@@ -325,13 +989,5 @@ func connectToDatabase(mongoURL string) {
 	shortenerCol = database.Collection("shorteners")
 	invisibleURL = database.Collection("invisibleurls")
 
-	defer fmt.Println("Connected to MongoDB cluster")
-}
-
-func deref(str *string) string {
-	if str != nil {
-		return *str
-	}
-
-	return ""
+	logger.Info().Msg("connected to MongoDB cluster")
 }
@@ -0,0 +1,65 @@
+// Package metrics exposes the proxy's Prometheus metrics and the fasthttp
+// handler that serves them on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var (
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "higure_proxy_requests_total",
+		Help: "Total requests handled, by route and status code.",
+	}, []string{"route", "status"})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "higure_proxy_request_duration_seconds",
+		Help: "Request latency in seconds, by route.",
+	}, []string{"route"})
+
+	S3Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "higure_proxy_storage_duration_seconds",
+		Help: "Storage backend call latency in seconds, by operation.",
+	}, []string{"operation"})
+
+	MongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "higure_proxy_mongo_duration_seconds",
+		Help: "Mongo query latency in seconds, by operation.",
+	}, []string{"operation"})
+
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "higure_proxy_cache_hits_total",
+		Help: "Total file-cache lookups that were served from cache.",
+	})
+
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "higure_proxy_cache_misses_total",
+		Help: "Total file-cache lookups that missed and fell through.",
+	})
+
+	BytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "higure_proxy_bytes_served_total",
+		Help: "Total response bytes served to clients.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		RequestsTotal,
+		RequestDuration,
+		S3Duration,
+		MongoDuration,
+		CacheHits,
+		CacheMisses,
+		BytesServed,
+	)
+}
+
+// Handler adapts promhttp's net/http handler to fasthttp for mounting at
+// /metrics.
+func Handler() fasthttp.RequestHandler {
+	return fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+}
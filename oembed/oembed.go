@@ -0,0 +1,142 @@
+// Package oembed discovers and fetches oEmbed representations of
+// shortened-link destinations, so /s/{shortId} can render a rich embed
+// instead of a bare redirect.
+package oembed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/valyala/fasthttp"
+)
+
+// Provider maps a destination URL pattern to an oEmbed endpoint template.
+// Endpoint may contain a "{format}" placeholder, substituted with "json".
+type Provider struct {
+	URLPattern string `json:"url_pattern"`
+	Endpoint   string `json:"endpoint"`
+}
+
+// Response mirrors the oEmbed spec fields the embed template can use.
+type Response struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	HTML         string `json:"html"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+type cacheEntry struct {
+	response  *Response
+	expiresAt time.Time
+}
+
+// Registry holds the configured providers and caches their responses.
+type Registry struct {
+	providers []Provider
+	ttl       time.Duration
+	cache     *lru.Cache
+}
+
+// Load reads a providers.json file (URL pattern -> endpoint template) and
+// bounds the fetched-response cache to cacheSize entries so it can't grow
+// without bound across distinct shortened-link destinations.
+func Load(path string, ttl time.Duration, cacheSize int) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []Provider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return nil, err
+	}
+
+	c, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registry{
+		providers: providers,
+		ttl:       ttl,
+		cache:     c,
+	}, nil
+}
+
+// Match returns the first provider whose URLPattern matches destination's
+// host, à la toby3d/oembed's provider-candidate matching. A "*.example.com"
+// pattern only matches subdomains, not the apex "example.com" — list the
+// apex separately in providers.json when a provider serves both. Other
+// domains a provider uses need their own entry too, as youtu.be has
+// alongside *.youtube.com.
+func (r *Registry) Match(destination string) (Provider, bool) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return Provider{}, false
+	}
+
+	for _, p := range r.providers {
+		if matched, _ := path.Match(p.URLPattern, u.Host); matched {
+			return p, true
+		}
+	}
+
+	return Provider{}, false
+}
+
+// Fetch calls provider's oEmbed endpoint for destination, caching the
+// result for ttl.
+func (r *Registry) Fetch(provider Provider, destination string, maxWidth, maxHeight int) (*Response, error) {
+	if v, ok := r.cache.Get(destination); ok {
+		e := v.(cacheEntry)
+		if time.Now().Before(e.expiresAt) {
+			return e.response, nil
+		}
+		r.cache.Remove(destination)
+	}
+
+	endpoint := provider.resolvedEndpoint()
+
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+	uri.Parse(nil, []byte(endpoint))
+	uri.QueryArgs().Set("url", destination)
+	if maxWidth > 0 {
+		uri.QueryArgs().Set("maxwidth", strconv.Itoa(maxWidth))
+	}
+	if maxHeight > 0 {
+		uri.QueryArgs().Set("maxheight", strconv.Itoa(maxHeight))
+	}
+
+	statusCode, body, err := fasthttp.Get(nil, uri.String())
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != fasthttp.StatusOK {
+		return nil, fmt.Errorf("oembed provider returned status %d", statusCode)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	r.cache.Add(destination, cacheEntry{response: &resp, expiresAt: time.Now().Add(r.ttl)})
+
+	return &resp, nil
+}
+
+func (p Provider) resolvedEndpoint() string {
+	return strings.ReplaceAll(p.Endpoint, "{format}", "json")
+}
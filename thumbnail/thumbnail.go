@@ -0,0 +1,38 @@
+// Package thumbnail computes BlurHash placeholders for uploaded images, so
+// embeds can show a gradient while the full image streams in.
+package thumbnail
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/buckket/go-blurhash"
+)
+
+// Result is the computed placeholder and the decoded image's dimensions.
+type Result struct {
+	Hash   string
+	Width  int
+	Height int
+}
+
+// Compute decodes an image from r and encodes a BlurHash string for it at
+// the given component resolution (see go-blurhash's Encode for what
+// xComponents/yComponents control).
+func Compute(r io.Reader, xComponents, yComponents int) (Result, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	hash, err := blurhash.Encode(xComponents, yComponents, img)
+	if err != nil {
+		return Result{}, err
+	}
+
+	bounds := img.Bounds()
+	return Result{Hash: hash, Width: bounds.Dx(), Height: bounds.Dy()}, nil
+}